@@ -0,0 +1,362 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+)
+
+const (
+	// fragmentReassemblyTimeout bounds how long a partial datagram is
+	// kept around waiting for its remaining fragments, roughly per the
+	// reassembly timeout guidance of RFC 791/RFC 6864.
+	fragmentReassemblyTimeout = 30 * time.Second
+	// fragmentCacheMemoryBudget bounds the total bytes of pending
+	// fragment payload an ipPort's fragmentReassembler will hold at
+	// once, so a flood of incomplete fragments can't exhaust memory.
+	fragmentCacheMemoryBudget = 4 * 1024 * 1024
+	// fragmentCacheMaxEntries bounds how many distinct (srcIP, dstIP,
+	// protocol, id) flows can have fragments pending simultaneously.
+	fragmentCacheMaxEntries = 4096
+)
+
+// fragmentKey identifies the IPv4 datagram a fragment belongs to, per
+// RFC 791: the tuple of source, destination, protocol and IP
+// identification field is unique for the lifetime of the datagram.
+type fragmentKey struct {
+	srcIP    types.IPv4Address
+	dstIP    types.IPv4Address
+	protocol uint8
+	id       uint16
+}
+
+// fragmentPiece is one received fragment's payload, recorded by its
+// offset within the reassembled datagram.
+type fragmentPiece struct {
+	offset int
+	data   []byte
+}
+
+// fragmentEntry tracks the fragments received so far for one datagram.
+type fragmentEntry struct {
+	pieces    []fragmentPiece
+	totalLen  int // full datagram length, known once the last fragment (MF=0) arrives
+	size      int // bytes buffered so far, for the memory budget
+	created   time.Time
+}
+
+func (e *fragmentEntry) complete() bool {
+	if e.totalLen == 0 {
+		return false
+	}
+	covered := make([]bool, e.totalLen)
+	for _, p := range e.pieces {
+		for i := p.offset; i < p.offset+len(p.data) && i < e.totalLen; i++ {
+			covered[i] = true
+		}
+	}
+	for _, c := range covered {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// reassemble concatenates buffered fragments into the full IPv4
+// payload. Caller must already know the entry is complete.
+func (e *fragmentEntry) reassemble() []byte {
+	out := make([]byte, e.totalLen)
+	for _, p := range e.pieces {
+		copy(out[p.offset:], p.data)
+	}
+	return out
+}
+
+// fragmentReassembler buffers IPv4 fragments until either the whole
+// datagram has arrived or fragmentReassemblyTimeout elapses. Each
+// ipPort owns one, keyed on the flows passing through it.
+type fragmentReassembler struct {
+	mu      sync.Mutex
+	entries map[fragmentKey]*fragmentEntry
+	used    int
+}
+
+func newFragmentReassembler() *fragmentReassembler {
+	return &fragmentReassembler{entries: make(map[fragmentKey]*fragmentEntry)}
+}
+
+// add records one fragment and returns the reassembled datagram payload
+// once all fragments for its key have arrived. ok is false while the
+// datagram is still incomplete (or was dropped because the cache is
+// over budget).
+func (r *fragmentReassembler) add(key fragmentKey, fragOffset int, moreFragments bool, totalIPLen int, payload []byte) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.evictExpiredLocked()
+
+	entry, found := r.entries[key]
+	if r.used+len(payload) > fragmentCacheMemoryBudget || (!found && len(r.entries) >= fragmentCacheMaxEntries) {
+		// Over budget: refuse to buffer this fragment rather than
+		// let an attacker exhaust memory with bogus fragments.
+		return nil, false
+	}
+	if !found {
+		entry = &fragmentEntry{created: time.Now()}
+		r.entries[key] = entry
+	}
+
+	entry.pieces = append(entry.pieces, fragmentPiece{offset: fragOffset, data: payload})
+	entry.size += len(payload)
+	r.used += len(payload)
+	if !moreFragments {
+		entry.totalLen = fragOffset + len(payload)
+	}
+
+	if entry.complete() {
+		data := entry.reassemble()
+		r.used -= entry.sizeLocked()
+		delete(r.entries, key)
+		return data, true
+	}
+	return nil, false
+}
+
+func (e *fragmentEntry) sizeLocked() int {
+	return e.size
+}
+
+// evictExpiredLocked drops datagrams that have been incomplete for
+// longer than fragmentReassemblyTimeout. Caller must hold r.mu.
+func (r *fragmentReassembler) evictExpiredLocked() {
+	now := time.Now()
+	for key, entry := range r.entries {
+		if now.Sub(entry.created) > fragmentReassemblyTimeout {
+			r.used -= entry.sizeLocked()
+			delete(r.entries, key)
+		}
+	}
+}
+
+// fragmentDatagram splits a reassembled (and now translated) IPv4
+// payload back into fragments no larger than mtu, mirroring what the
+// original sender's fragmentation would have produced. Each returned
+// slice is a fragment's payload (the part after the IPv4 header),
+// aligned to an 8-byte boundary as IPv4 fragmentation requires.
+func fragmentDatagram(payload []byte, mtu int) [][]byte {
+	if len(payload) <= mtu {
+		return [][]byte{payload}
+	}
+	chunk := mtu &^ 7 // fragment offsets are in 8-byte units
+	var out [][]byte
+	for off := 0; off < len(payload); off += chunk {
+		end := off + chunk
+		if end > len(payload) {
+			end = len(payload)
+		}
+		out = append(out, payload[off:end])
+	}
+	return out
+}
+
+// ipv4MoreFragmentsFlag and ipv4FragOffsetMask decode the flags+offset
+// field of an IPv4 header, which FragmentOffset stores in network byte
+// order.
+const (
+	ipv4MoreFragmentsFlag = 0x2000
+	ipv4FragOffsetMask    = 0x1fff
+)
+
+func ipv4FlagsAndOffset(hdr *packet.IPv4Hdr) uint16 {
+	return packet.SwapBytesUint16(hdr.FragmentOffset)
+}
+
+// isIPv4Fragment reports whether hdr represents a non-final fragment
+// (MF=1) or a trailing fragment of an already-fragmented datagram
+// (non-zero fragment offset), either of which means the L4 header is
+// not present in this packet.
+func isIPv4Fragment(hdr *packet.IPv4Hdr) bool {
+	v := ipv4FlagsAndOffset(hdr)
+	return v&ipv4MoreFragmentsFlag != 0 || v&ipv4FragOffsetMask != 0
+}
+
+// reassembleFragment feeds pkt's IPv4 payload into port's
+// fragmentReassembler. It returns the fully reassembled datagram and
+// true once the last outstanding fragment has arrived; otherwise the
+// fragment has been buffered (or dropped, if the cache is over
+// budget) and the caller should stop processing this packet. Once
+// complete, the caller must replace pkt's payload with the returned
+// bytes (applyReassembledIPv4Payload) before running translation, so
+// that ParseAllKnownL4 sees the real L4 header rather than whichever
+// fragment happened to complete the datagram.
+// payload is the packet's actual captured bytes following pktIPv4
+// (i.e. pkt.GetPacketPayload()), not reconstructed from pktIPv4's own
+// TotalLength field: TotalLength is only a claim, and trusting it to
+// size a read would let a corrupt or hostile header claim more data
+// than the packet buffer actually holds.
+func (port *ipPort) reassembleFragment(pktIPv4 *packet.IPv4Hdr, payload []byte) ([]byte, bool) {
+	v := ipv4FlagsAndOffset(pktIPv4)
+	fragOffset := int(v&ipv4FragOffsetMask) * 8
+	moreFragments := v&ipv4MoreFragmentsFlag != 0
+
+	key := fragmentKey{
+		srcIP:    packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr),
+		dstIP:    packet.SwapBytesIPv4Addr(pktIPv4.DstAddr),
+		protocol: pktIPv4.NextProtoID,
+		id:       packet.SwapBytesUint16(pktIPv4.PacketID),
+	}
+	if claimed := int(packet.SwapBytesUint16(pktIPv4.TotalLength)) - ipv4HeaderLen(pktIPv4); claimed >= 0 && claimed < len(payload) {
+		payload = payload[:claimed]
+	}
+	return port.fragments.add(key, fragOffset, moreFragments, int(packet.SwapBytesUint16(pktIPv4.TotalLength)), payload)
+}
+
+// reassembleEmbeddedFragment is reassembleFragment's counterpart for
+// the original datagram's IPv4 header embedded in an ICMPv4 error
+// message's payload (RFC 792 section 3): that embedded header
+// identifies the same (srcIP, dstIP, protocol, id) fragment flow as
+// whatever datagram triggered the error, so handleICMP reassembles it
+// through this port's own fragmentReassembler rather than assuming an
+// embedded fragment is always already complete. ok is true immediately,
+// with embeddedPayload returned unchanged, when embedded isn't itself
+// fragmented.
+func (port *ipPort) reassembleEmbeddedFragment(embedded *packet.IPv4Hdr, embeddedPayload []byte) (data []byte, ok bool) {
+	if !isIPv4Fragment(embedded) {
+		return embeddedPayload, true
+	}
+	v := ipv4FlagsAndOffset(embedded)
+	fragOffset := int(v&ipv4FragOffsetMask) * 8
+	moreFragments := v&ipv4MoreFragmentsFlag != 0
+
+	key := fragmentKey{
+		srcIP:    packet.SwapBytesIPv4Addr(embedded.SrcAddr),
+		dstIP:    packet.SwapBytesIPv4Addr(embedded.DstAddr),
+		protocol: embedded.NextProtoID,
+		id:       packet.SwapBytesUint16(embedded.PacketID),
+	}
+	// embedded.TotalLength is the trigger datagram's original, full
+	// length, not how much of it this ICMP error actually echoed back
+	// (RFC 792 guarantees only a small truncated prefix); embeddedPayload
+	// has already been bounded to what's really present, by
+	// ipv4PayloadBytes at the call site, so never extend past it.
+	if claimed := int(packet.SwapBytesUint16(embedded.TotalLength)) - ipv4HeaderLen(embedded); claimed >= 0 && claimed < len(embeddedPayload) {
+		embeddedPayload = embeddedPayload[:claimed]
+	}
+	return port.fragments.add(key, fragOffset, moreFragments, int(packet.SwapBytesUint16(embedded.TotalLength)), embeddedPayload)
+}
+
+// applyReassembledIPv4Payload replaces pkt's IPv4 payload with the
+// fully reassembled datagram bytes and clears pktIPv4's fragmentation
+// fields, so that the packet can be translated exactly as an ordinary
+// unfragmented datagram would be. It returns false if resizing pkt's
+// payload failed.
+func applyReassembledIPv4Payload(pkt *packet.Packet, pktIPv4 *packet.IPv4Hdr, reassembled []byte) bool {
+	if resizePacketPayload(pkt, reassembled) == nil {
+		return false
+	}
+	pktIPv4.FragmentOffset = 0
+	pktIPv4.TotalLength = packet.SwapBytesUint16(uint16(ipv4HeaderLen(pktIPv4) + len(reassembled)))
+	pkt.ParseL3()
+	return true
+}
+
+// resizePacketPayload grows or shrinks pkt's payload (the bytes
+// GetPacketPayload returns, i.e. everything after the parsed L3/L4
+// headers) to hold data, copying it in, and returns the resulting
+// payload slice, or nil if growing the underlying mbuf failed. It is
+// shared by fragment reassembly, which typically grows a single
+// fragment's payload up to the full datagram, and the STUN responder,
+// which may need to grow a bare request into a larger response.
+func resizePacketPayload(pkt *packet.Packet, data []byte) []byte {
+	payload := pkt.GetPacketPayload()
+	switch {
+	case len(data) < len(payload):
+		pkt.TrimPacketPayload(len(payload) - len(data))
+	case len(data) > len(payload):
+		if err := pkt.EncapsulateTail(len(payload), len(data)-len(payload)); err != nil {
+			return nil
+		}
+	}
+	payload = pkt.GetPacketPayload()
+	copy(payload, data)
+	return payload
+}
+
+// SendWithRefragmentation is the per-port egress helper the flow
+// pipeline's send stage calls once a Splitter (PublicToPrivateTranslation
+// or PrivateToPublicTranslation) has routed pkt to DirSEND. If pkt's
+// IPv4 payload already fits within mtu, send is called once with pkt
+// unchanged; otherwise fragmentDatagram splits it and send is called
+// once per resulting fragment, each carrying pktIPv4's header with a
+// fresh FragmentOffset/MF pair, as RFC 791 requires of any node that
+// forwards a datagram too large for the next hop.
+func (port *ipPort) SendWithRefragmentation(pkt *packet.Packet, pktIPv4 *packet.IPv4Hdr, mtu int, send func(*packet.Packet)) {
+	if pktIPv4 == nil || mtu <= 0 {
+		send(pkt)
+		return
+	}
+	payload := pkt.GetPacketPayload()
+	if len(payload) <= mtu {
+		send(pkt)
+		return
+	}
+
+	hdrLen := ipv4HeaderLen(pktIPv4)
+	chunks := fragmentDatagram(payload, mtu)
+	offsetUnits := uint16(0)
+	for i, chunk := range chunks {
+		frag, err := packet.NewPacket()
+		if err != nil {
+			return
+		}
+		packet.InitEmptyIPv4Packet(frag, uint(hdrLen+len(chunk)))
+		*frag.GetIPv4NoCheck() = *pktIPv4
+		fragIPv4 := frag.GetIPv4NoCheck()
+
+		more := uint16(0)
+		if i != len(chunks)-1 {
+			more = ipv4MoreFragmentsFlag
+		}
+		fragIPv4.FragmentOffset = packet.SwapBytesUint16(offsetUnits | more)
+		fragIPv4.TotalLength = packet.SwapBytesUint16(uint16(hdrLen + len(chunk)))
+		copy(frag.GetPacketPayload(), chunk)
+		offsetUnits += uint16(len(chunk) / 8)
+
+		send(frag)
+	}
+}
+
+// ipv4HeaderLen returns the IPv4 header length in bytes, accounting
+// for a variable-length options section.
+func ipv4HeaderLen(hdr *packet.IPv4Hdr) int {
+	return int(hdr.VersionIhl&0x0f) * 4
+}
+
+// ipv4PayloadBytes returns the bytes following hdr up to TotalLength,
+// i.e. the portion of the datagram this fragment contributes, clipped
+// to available (the number of real captured bytes starting at hdr).
+// hdr's own TotalLength is only the sender's claim: for hdr embedded
+// in an ICMP error this is the original, typically-larger datagram's
+// length, not how much of it the error actually echoed, and trusting
+// it unclipped would read past the real packet buffer.
+func ipv4PayloadBytes(hdr *packet.IPv4Hdr, available int) []byte {
+	totalLen := int(packet.SwapBytesUint16(hdr.TotalLength))
+	hdrLen := ipv4HeaderLen(hdr)
+	payloadLen := totalLen - hdrLen
+	if max := available - hdrLen; payloadLen > max {
+		payloadLen = max
+	}
+	if payloadLen <= 0 {
+		return nil
+	}
+	base := unsafe.Pointer(uintptr(unsafe.Pointer(hdr)) + uintptr(hdrLen))
+	return unsafe.Slice((*byte)(base), payloadLen)
+}
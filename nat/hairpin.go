@@ -0,0 +1,140 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+)
+
+// HairpinMode controls how a port pair handles a private host sending
+// to the NAT's own public (address, port) mapping of another private
+// host, mirroring the hairpinning modes of the Tailscale natlab NAT
+// simulator.
+type HairpinMode uint8
+
+const (
+	// HairpinOff never loops traffic back to the private side; it is
+	// forwarded (or dropped) as ordinary egress traffic. Default.
+	HairpinOff HairpinMode = iota
+	// HairpinSameHost only loops traffic back when the destination
+	// mapping belongs to the same private host that sent it.
+	HairpinSameHost
+	// HairpinFull loops traffic back for any destination mapping found
+	// in translationTable, regardless of which private host owns it.
+	HairpinFull
+)
+
+// DirPrivateLoop routes a packet back out the private port it
+// arrived on, rather than out the public port as PrivateToPublicTranslation's
+// DirSEND does. Flow setup must wire this output of
+// PrivateToPublicTranslation to the private port's own send queue for
+// hairpinning to work.
+const DirPrivateLoop = DirKNI + 1
+
+// findHairpinTarget looks up (addr, port) in the public port's
+// translationTable for protocol and returns the private entry it maps
+// to, if any. It is used by PrivateToPublicTranslation to detect a
+// private host addressing another private host via the NAT's public
+// mapping. protocol must be the hairpin candidate packet's own
+// protocol: each protocol allocates ports independently, so a TCP and
+// a UDP mapping can legitimately share the same public (addr, port)
+// for two different private hosts, and checking the wrong protocol's
+// table could hairpin-translate using the wrong one's target.
+func (pp *portPair) findHairpinTarget(ipv6 bool, protocol uint8, addr types.IPv4Address, addr6 types.IPv6Address, port uint16) (interface{}, bool) {
+	var key interface{}
+	if ipv6 {
+		key = Tuple6{addr: addr6, port: port}
+	} else {
+		key = Tuple{addr: addr, port: port}
+	}
+	return pp.PublicPort.translationTable[protocol].Load(key)
+}
+
+// hairpinTranslate rewrites pkt for a detected hairpin flow: the
+// source is translated exactly as ordinary egress traffic would be
+// (allocating a mapping if one doesn't exist yet), while the
+// destination is translated back from its public mapping to the
+// target private host, mirroring PublicToPrivateTranslation. The
+// packet is then looped back out the private port instead of being
+// forwarded to the public port.
+func (pp *portPair) hairpinTranslate(pkt *packet.Packet, ipv6 bool, protocol uint8, pri2pubKey interface{}, target interface{}, pktVLAN *packet.VLANHdr, pktIPv4 *packet.IPv4Hdr, pktIPv6 *packet.IPv6Hdr, pktTCP *packet.TCPHdr, pktUDP *packet.UDPHdr, pktICMP *packet.ICMPHdr) uint {
+	port := &pp.PrivatePort
+
+	// Translate source, allocating a mapping if this is the first
+	// packet of the flow, exactly as ordinary egress traffic does.
+	v, found := port.translationTable[protocol].Load(pri2pubKey)
+	var srcV4 types.IPv4Address
+	var srcV6 types.IPv6Address
+	var srcPort uint16
+	if !found {
+		var err error
+		var privAddr6 types.IPv6Address
+		var dstAddr6 types.IPv6Address
+		if ipv6 {
+			privAddr6 = pktIPv6.SrcAddr
+			dstAddr6 = pktIPv6.DstAddr
+		}
+		srcV4, srcV6, srcPort, err = pp.allocateNewEgressConnection(ipv6, protocol, pri2pubKey, privAddr6, dstAddr6, 0)
+		if err != nil {
+			println("Warning! Failed to allocate new hairpin connection", err)
+			port.dumpPacket(pkt, DirDROP)
+			return DirDROP
+		}
+	} else {
+		srcV4, srcV6, srcPort, _ = getAddrFromTuple(v, ipv6)
+	}
+
+	// Translate destination from its public mapping back to the
+	// target private host.
+	dstV4, dstV6, dstPort, zeroAddr := getAddrFromTuple(target, ipv6)
+	if zeroAddr {
+		port.dumpPacket(pkt, DirDROP)
+		return DirDROP
+	}
+
+	var mac types.MACAddress
+	if ipv6 {
+		mac, found = port.getMACForIPv6(dstV6)
+	} else {
+		mac, found = port.getMACForIPv4(dstV4)
+	}
+	if !found {
+		port.dumpPacket(pkt, DirDROP)
+		return DirDROP
+	}
+
+	pkt.Ether.DAddr = mac
+	pkt.Ether.SAddr = port.SrcMACAddress
+	if pktVLAN != nil {
+		pktVLAN.SetVLANTagIdentifier(port.Vlan)
+	}
+	if ipv6 {
+		pktIPv6.SrcAddr = srcV6
+		pktIPv6.DstAddr = dstV6
+	} else {
+		pktIPv4.SrcAddr = packet.SwapBytesIPv4Addr(srcV4)
+		pktIPv4.DstAddr = packet.SwapBytesIPv4Addr(dstV4)
+	}
+	setPacketSrcPort(pkt, ipv6, srcPort, pktTCP, pktUDP, pktICMP)
+	setPacketDstPort(pkt, ipv6, dstPort, pktTCP, pktUDP, pktICMP)
+
+	port.dumpPacket(pkt, DirPrivateLoop)
+	return DirPrivateLoop
+}
+
+// samePrivateHost reports whether the two private-side mappingKey
+// values (as stored for the opposite direction's entry in
+// translationTable) belong to the same private host address.
+func samePrivateHost(ipv6 bool, a, b interface{}) bool {
+	if ipv6 {
+		va, oka := a.(mappingKey6)
+		vb, okb := b.(mappingKey6)
+		return oka && okb && va.addr == vb.addr
+	}
+	va, oka := a.(mappingKey)
+	vb, okb := b.(mappingKey)
+	return oka && okb && va.addr == vb.addr
+}
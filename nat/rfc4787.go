@@ -0,0 +1,174 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"sync"
+
+	"github.com/intel-go/nff-go/types"
+)
+
+// MappingBehavior selects how new outbound mappings are keyed, as
+// described in RFC 4787 section 4.1. EndpointIndependentMapping is the
+// default and matches the NAT's original behavior: a single public
+// mapping is reused for a given private (address, port) regardless of
+// the remote endpoint it is talking to.
+type MappingBehavior uint8
+
+const (
+	// EndpointIndependentMapping reuses one mapping per private
+	// (address, port) for all remote destinations. Default.
+	EndpointIndependentMapping MappingBehavior = iota
+	// AddressDependentMapping allocates a distinct mapping per remote
+	// address, reusing it across remote ports.
+	AddressDependentMapping
+	// AddressAndPortDependentMapping allocates a distinct mapping per
+	// remote (address, port) pair.
+	AddressAndPortDependentMapping
+)
+
+// FilteringBehavior selects which inbound packets are allowed to match
+// an existing mapping, as described in RFC 4787 section 5.
+// EndpointIndependentFiltering is the default and matches the NAT's
+// original behavior: any remote host may reach the mapping once it is
+// created.
+type FilteringBehavior uint8
+
+const (
+	// EndpointIndependentFiltering allows any remote endpoint to reach
+	// an existing mapping. Default.
+	EndpointIndependentFiltering FilteringBehavior = iota
+	// AddressDependentFiltering only allows remotes whose address has
+	// previously been sent to through the mapping.
+	AddressDependentFiltering
+	// AddressAndPortDependentFiltering only allows remotes whose
+	// (address, port) has previously been sent to through the mapping.
+	AddressAndPortDependentFiltering
+)
+
+// mappingKey identifies an entry in translationTable for IPv4 flows.
+// remoteAddr and remotePort are only populated when the port pair's
+// MappingBehavior requires them, so EndpointIndependentMapping keys
+// degrade to the pre-RFC-4787 (addr, port) key.
+type mappingKey struct {
+	addr       types.IPv4Address
+	port       uint16
+	remoteAddr types.IPv4Address
+	remotePort uint16
+}
+
+// mappingKey6 is the IPv6 counterpart of mappingKey.
+type mappingKey6 struct {
+	addr       types.IPv6Address
+	port       uint16
+	remoteAddr types.IPv6Address
+	remotePort uint16
+}
+
+func makeMappingKey(mode MappingBehavior, addr types.IPv4Address, port uint16, remoteAddr types.IPv4Address, remotePort uint16) mappingKey {
+	key := mappingKey{addr: addr, port: port}
+	if mode >= AddressDependentMapping {
+		key.remoteAddr = remoteAddr
+	}
+	if mode >= AddressAndPortDependentMapping {
+		key.remotePort = remotePort
+	}
+	return key
+}
+
+func makeMappingKey6(mode MappingBehavior, addr types.IPv6Address, port uint16, remoteAddr types.IPv6Address, remotePort uint16) mappingKey6 {
+	key := mappingKey6{addr: addr, port: port}
+	if mode >= AddressDependentMapping {
+		key.remoteAddr = remoteAddr
+	}
+	if mode >= AddressAndPortDependentMapping {
+		key.remotePort = remotePort
+	}
+	return key
+}
+
+// remoteEndpoint identifies a remote that egress traffic has been sent
+// to via a mapping; inbound packets from a remote do not add it. It is
+// the unit tracked by allowedRemoteSet to implement RFC 4787 filtering
+// behaviors.
+type remoteEndpoint struct {
+	addr types.IPv4Address
+	port uint16
+}
+
+type remoteEndpoint6 struct {
+	addr types.IPv6Address
+	port uint16
+}
+
+// allowedRemoteSet tracks the remotes a mapping's filtering behavior
+// permits to reach it. It is stored alongside each portMapEntry so that
+// PublicToPrivateTranslation can drop unsolicited inbound packets from
+// remotes that don't match the configured FilteringBehavior.
+//
+// allow runs from PrivateToPublicTranslation and check runs from
+// PublicToPrivateTranslation for the same mapping, and the two
+// directions of a flow can run concurrently on different queues; mu
+// guards v4/v6 so that doesn't race two goroutines into a bare Go map,
+// which is a hard crash rather than just a correctness bug.
+type allowedRemoteSet struct {
+	filtering FilteringBehavior
+	mu        sync.Mutex
+	v4        map[remoteEndpoint]bool
+	v6        map[remoteEndpoint6]bool
+}
+
+func newAllowedRemoteSet(filtering FilteringBehavior) *allowedRemoteSet {
+	return &allowedRemoteSet{
+		filtering: filtering,
+		v4:        make(map[remoteEndpoint]bool),
+		v6:        make(map[remoteEndpoint6]bool),
+	}
+}
+
+// allow records that traffic has legitimately flowed to remoteAddr:remotePort
+// through this mapping, per the egress (private to public) direction.
+func (s *allowedRemoteSet) allow(ipv6 bool, remoteAddr types.IPv4Address, remoteAddr6 types.IPv6Address, remotePort uint16) {
+	if s == nil || s.filtering == EndpointIndependentFiltering {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ipv6 {
+		key := remoteEndpoint6{addr: remoteAddr6, port: remotePort}
+		if s.filtering == AddressDependentFiltering {
+			key.port = 0
+		}
+		s.v6[key] = true
+	} else {
+		key := remoteEndpoint{addr: remoteAddr, port: remotePort}
+		if s.filtering == AddressDependentFiltering {
+			key.port = 0
+		}
+		s.v4[key] = true
+	}
+}
+
+// check reports whether an inbound packet from remoteAddr:remotePort is
+// allowed to match this mapping.
+func (s *allowedRemoteSet) check(ipv6 bool, remoteAddr types.IPv4Address, remoteAddr6 types.IPv6Address, remotePort uint16) bool {
+	if s == nil || s.filtering == EndpointIndependentFiltering {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ipv6 {
+		key := remoteEndpoint6{addr: remoteAddr6, port: remotePort}
+		if s.filtering == AddressDependentFiltering {
+			key.port = 0
+		}
+		return s.v6[key]
+	}
+	key := remoteEndpoint{addr: remoteAddr, port: remotePort}
+	if s.filtering == AddressDependentFiltering {
+		key.port = 0
+	}
+	return s.v4[key]
+}
@@ -0,0 +1,151 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"encoding/binary"
+
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+)
+
+// defaultStunPort is the standard STUN port (RFC 5389). StunPort is
+// not defaulted to it: a port whose StunPort is 0 runs no responder.
+const defaultStunPort = 3478
+
+// DirPublicLoop routes a packet back out the public port it arrived
+// on, the STUN-reply counterpart of DirPrivateLoop. Flow setup must
+// wire this output of PublicToPrivateTranslation to the public port's
+// own send queue.
+const DirPublicLoop = DirPrivateLoop + 1
+
+// STUN (RFC 5389) constants needed for a minimal Binding
+// request/response exchange. Only what's required for NAT-type
+// discovery is implemented; STUN's other methods and attributes are
+// out of scope.
+const (
+	stunHeaderLen   = 20
+	stunMagicCookie = 0x2112A442
+
+	stunMethodBinding       = 0x0001
+	stunClassRequest        = 0x0000
+	stunClassSuccessResp    = 0x0100
+	stunBindingRequest      = stunMethodBinding | stunClassRequest
+	stunBindingSuccessResp  = stunMethodBinding | stunClassSuccessResp
+
+	stunAttrXorMappedAddress = 0x0020
+
+	stunFamilyIPv4 = 0x01
+	stunFamilyIPv6 = 0x02
+)
+
+// stunTransactionID is the 12-byte transaction ID STUN uses to match
+// requests with responses.
+type stunTransactionID [12]byte
+
+// parseSTUNBindingRequest reports whether payload is a well-formed
+// RFC 5389 STUN Binding Request, returning its transaction ID if so.
+func parseSTUNBindingRequest(payload []byte) (stunTransactionID, bool) {
+	var txID stunTransactionID
+	if len(payload) < stunHeaderLen {
+		return txID, false
+	}
+	msgType := binary.BigEndian.Uint16(payload[0:2])
+	msgLen := binary.BigEndian.Uint16(payload[2:4])
+	cookie := binary.BigEndian.Uint32(payload[4:8])
+	if msgType != stunBindingRequest || cookie != stunMagicCookie {
+		return txID, false
+	}
+	if int(msgLen)+stunHeaderLen > len(payload) {
+		return txID, false
+	}
+	copy(txID[:], payload[8:20])
+	return txID, true
+}
+
+// buildSTUNXorMappedAddressResponse builds an RFC 5389 Binding Success
+// Response carrying a single XOR-MAPPED-ADDRESS attribute set to
+// (addr, port), as observed by the NAT.
+func buildSTUNXorMappedAddressResponse(txID stunTransactionID, ipv6 bool, addr4 types.IPv4Address, addr6 types.IPv6Address, port uint16) []byte {
+	var attr []byte
+	if ipv6 {
+		attr = make([]byte, 4+16)
+		attr[0] = 0
+		attr[1] = stunFamilyIPv6
+		binary.BigEndian.PutUint16(attr[2:4], port^uint16(stunMagicCookie>>16))
+		xorBytes := addr6[:]
+		var cookieAndTxID [16]byte
+		binary.BigEndian.PutUint32(cookieAndTxID[0:4], stunMagicCookie)
+		copy(cookieAndTxID[4:16], txID[:])
+		for i := 0; i < 16; i++ {
+			attr[4+i] = xorBytes[i] ^ cookieAndTxID[i]
+		}
+	} else {
+		attr = make([]byte, 4+4)
+		attr[0] = 0
+		attr[1] = stunFamilyIPv4
+		binary.BigEndian.PutUint16(attr[2:4], port^uint16(stunMagicCookie>>16))
+		var addrBytes [4]byte
+		binary.BigEndian.PutUint32(addrBytes[:], uint32(addr4))
+		binary.BigEndian.PutUint32(addrBytes[:], uint32(addr4)^stunMagicCookie)
+		copy(attr[4:8], addrBytes[:])
+	}
+
+	body := make([]byte, 4+len(attr))
+	binary.BigEndian.PutUint16(body[0:2], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(attr)))
+	copy(body[4:], attr)
+
+	msg := make([]byte, stunHeaderLen+len(body))
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingSuccessResp)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(body)))
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:20], txID[:])
+	copy(msg[20:], body)
+	return msg
+}
+
+// handleSTUNBindingRequest answers a STUN Binding Request addressed
+// to stunPort with observedAddr:observedPort as the XOR-MAPPED-ADDRESS,
+// overwriting pkt in place (Ethernet and IP source/destination are
+// swapped, the UDP payload becomes the STUN response) so that the
+// caller can send it straight back out the port it arrived on.
+//
+// The same helper serves both STUN entry points described in the NAT
+// configuration: the public port answering external probes with the
+// requester's own observed address, and the private port answering a
+// private host's query about its own allocated public mapping.
+func handleSTUNBindingRequest(pkt *packet.Packet, pktIPv4 *packet.IPv4Hdr, pktIPv6 *packet.IPv6Hdr, pktUDP *packet.UDPHdr, ipv6 bool, observedAddr4 types.IPv4Address, observedAddr6 types.IPv6Address, observedPort uint16) bool {
+	payload := pkt.GetPacketPayload()
+	txID, ok := parseSTUNBindingRequest(payload)
+	if !ok {
+		return false
+	}
+
+	resp := buildSTUNXorMappedAddressResponse(txID, ipv6, observedAddr4, observedAddr6, observedPort)
+
+	srcMAC, dstMAC := pkt.Ether.SAddr, pkt.Ether.DAddr
+	pkt.Ether.SAddr, pkt.Ether.DAddr = dstMAC, srcMAC
+	if ipv6 {
+		pktIPv6.SrcAddr, pktIPv6.DstAddr = pktIPv6.DstAddr, pktIPv6.SrcAddr
+	} else {
+		pktIPv4.SrcAddr, pktIPv4.DstAddr = pktIPv4.DstAddr, pktIPv4.SrcAddr
+	}
+	pktUDP.SrcPort, pktUDP.DstPort = pktUDP.DstPort, pktUDP.SrcPort
+
+	if resizePacketPayload(pkt, resp) == nil {
+		return false
+	}
+	const udpHeaderLen = 8
+	pktUDP.DgramLen = packet.SwapBytesUint16(uint16(udpHeaderLen + len(resp)))
+	if ipv6 {
+		pktIPv6.PayloadLen = pktUDP.DgramLen
+	} else {
+		pktIPv4.TotalLength = packet.SwapBytesUint16(uint16(ipv4HeaderLen(pktIPv4)) + uint16(packet.SwapBytesUint16(pktUDP.DgramLen)))
+	}
+	pkt.ParseL3() // refresh pkt's L3 pointer after the resize; checksums are not updated here
+
+	return true
+}
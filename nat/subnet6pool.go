@@ -0,0 +1,138 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/intel-go/nff-go/types"
+)
+
+// AddressSelectionPolicy controls how allocateNewEgressConnection
+// picks a source address out of ipSubnet6's pool of acquired global
+// unicast addresses when there is more than one, e.g. after a
+// DHCPv6-PD delegation wider than a single /128.
+type AddressSelectionPolicy uint8
+
+const (
+	// AddressSelectRoundRobin cycles through the pool in order,
+	// spreading new egress connections evenly across it. Default.
+	AddressSelectRoundRobin AddressSelectionPolicy = iota
+	// AddressSelectHash picks an address by hashing the private
+	// (src, dstIP, dstPort), so a given private flow always maps to
+	// the same public address for as long as the pool is unchanged.
+	AddressSelectHash
+	// AddressSelectPinned picks the pool entry whose PinnedPrefix
+	// contains the private source address, falling back to the first
+	// pool entry if none matches.
+	AddressSelectPinned
+)
+
+// addressPoolEntry is one global unicast address available for
+// egress source selection.
+type addressPoolEntry struct {
+	addr types.IPv6Address
+	// pinnedPrefix and pinnedPrefixLen are only consulted under
+	// AddressSelectPinned; a zero pinnedPrefixLen matches nothing.
+	pinnedPrefix    types.IPv6Address
+	pinnedPrefixLen uint8
+}
+
+// isGlobalUnicastIPv6 reports whether addr falls in the 2000::/3
+// global unicast range, excluding link-local (fe80::/10) and unique
+// local (fc00::/7) addresses the way well-behaved outbound-selection
+// code must.
+func isGlobalUnicastIPv6(addr types.IPv6Address) bool {
+	return addr[0]&0xe0 == 0x20
+}
+
+// matchesIPv6Prefix reports whether addr falls within prefix/prefixLen.
+func matchesIPv6Prefix(addr, prefix types.IPv6Address, prefixLen uint8) bool {
+	if prefixLen == 0 {
+		return false
+	}
+	fullBytes := int(prefixLen / 8)
+	for i := 0; i < fullBytes; i++ {
+		if addr[i] != prefix[i] {
+			return false
+		}
+	}
+	if rem := prefixLen % 8; rem != 0 {
+		mask := byte(0xff << (8 - rem))
+		if addr[fullBytes]&mask != prefix[fullBytes]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// hashPrivateEndpoint6 hashes the private (src, dstIP, dstPort) tuple
+// for AddressSelectHash, so repeated connections from the same private
+// flow land on the same pool address.
+func hashPrivateEndpoint6(src, dst types.IPv6Address, dstPort uint16) uint32 {
+	h := fnv.New32a()
+	h.Write(src[:])
+	h.Write(dst[:])
+	h.Write([]byte{byte(dstPort >> 8), byte(dstPort)})
+	return h.Sum32()
+}
+
+// selectEgressAddr6 picks the public IPv6 source address for a new
+// egress mapping according to pp.PublicPort.Subnet6's AddressSelectionPolicy
+// and address pool, falling back to the subnet's single Addr when no
+// pool has been configured.
+func (pp *portPair) selectEgressAddr6(src, dst types.IPv6Address, dstPort uint16) types.IPv6Address {
+	subnet := &pp.PublicPort.Subnet6
+	if len(subnet.Pool) == 0 {
+		return subnet.Addr
+	}
+
+	switch subnet.AddressSelection {
+	case AddressSelectHash:
+		idx := hashPrivateEndpoint6(src, dst, dstPort) % uint32(len(subnet.Pool))
+		return subnet.Pool[idx].addr
+	case AddressSelectPinned:
+		for _, entry := range subnet.Pool {
+			if matchesIPv6Prefix(src, entry.pinnedPrefix, entry.pinnedPrefixLen) {
+				return entry.addr
+			}
+		}
+		return subnet.Pool[0].addr
+	default: // AddressSelectRoundRobin
+		idx := atomic.AddUint32(&subnet.rrCounter, 1)
+		return subnet.Pool[idx%uint32(len(subnet.Pool))].addr
+	}
+}
+
+// AddPoolAddress appends addr to the subnet's egress address pool for
+// selectEgressAddr6 to choose from, refusing (returning false) any
+// address that isn't global unicast: a link-local or unique-local
+// address must never be handed out as a NAT's public source address,
+// however it was configured.
+func (s *ipSubnet6) AddPoolAddress(addr types.IPv6Address, pinnedPrefix types.IPv6Address, pinnedPrefixLen uint8) bool {
+	if !isGlobalUnicastIPv6(addr) {
+		return false
+	}
+	s.Pool = append(s.Pool, addressPoolEntry{addr: addr, pinnedPrefix: pinnedPrefix, pinnedPrefixLen: pinnedPrefixLen})
+	return true
+}
+
+// ownsIPv6Address reports whether addr is one this port should answer
+// neighbor solicitations for: its primary Subnet6.Addr or any address
+// in Subnet6.Pool. handleICMP's NDP handling consults this rather than
+// comparing against Subnet6.Addr alone, since a port can have more
+// than one acquired global address.
+func (port *ipPort) ownsIPv6Address(addr types.IPv6Address) bool {
+	if port.Subnet6.Addr == addr {
+		return true
+	}
+	for _, entry := range port.Subnet6.Pool {
+		if entry.addr == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -23,7 +23,7 @@ type Tuple6 struct {
 	port uint16
 }
 
-func (pp *portPair) allocateNewEgressConnection(ipv6 bool, protocol uint8, privEntry interface{}) (types.IPv4Address, types.IPv6Address, uint16, error) {
+func (pp *portPair) allocateNewEgressConnection(ipv6 bool, protocol uint8, privEntry interface{}, privAddr6, remoteAddr6 types.IPv6Address, remotePort uint16) (types.IPv4Address, types.IPv6Address, uint16, error) {
 	pp.mutex.Lock()
 
 	port, err := pp.allocNewPort(ipv6, protocol)
@@ -36,7 +36,7 @@ func (pp *portPair) allocateNewEgressConnection(ipv6 bool, protocol uint8, privE
 	var v4addr types.IPv4Address
 	var v6addr types.IPv6Address
 	if ipv6 {
-		v6addr = pp.PublicPort.Subnet6.Addr
+		v6addr = pp.selectEgressAddr6(privAddr6, remoteAddr6, remotePort)
 		pubEntry = Tuple6{
 			addr: v6addr,
 			port: uint16(port),
@@ -54,6 +54,7 @@ func (pp *portPair) allocateNewEgressConnection(ipv6 bool, protocol uint8, privE
 		finCount:             0,
 		terminationDirection: 0,
 		static:               false,
+		allowedRemotes:       newAllowedRemoteSet(pp.FilteringBehavior),
 	}
 
 	// Add lookup entries for packet translation
@@ -78,21 +79,44 @@ func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 		return dir
 	}
 
-	protocol, pktTCP, pktUDP, pktICMP, _, DstPort := ParseAllKnownL4(pkt, pktIPv4, pktIPv6)
+	// IPv4 fragments other than the first carry no L4 header, so
+	// ParseAllKnownL4 can't classify them; buffer every fragment, the
+	// first included, until the datagram can be reassembled and run
+	// translation on the whole thing.
+	if pktIPv4 != nil && isIPv4Fragment(pktIPv4) {
+		reassembled, complete := port.reassembleFragment(pktIPv4, pkt.GetPacketPayload())
+		if !complete {
+			port.dumpPacket(pkt, DirDROP)
+			return DirDROP
+		}
+		if !applyReassembledIPv4Payload(pkt, pktIPv4, reassembled) {
+			port.dumpPacket(pkt, DirDROP)
+			return DirDROP
+		}
+	}
+
+	protocol, pktTCP, pktUDP, pktICMP, SrcPort, DstPort := ParseAllKnownL4(pkt, pktIPv4, pktIPv6)
 	if protocol == 0 {
 		// Only TCP, UDP and ICMP are supported now, all other protocols are ignored
 		port.dumpPacket(pkt, DirDROP)
 		return DirDROP
 	}
 	portNumber := DstPort
-	// Create a lookup key from packet destination address and port
+	// Create a lookup key from packet destination address and port. The
+	// mapping itself is always keyed on the public (addr, port) alone;
+	// it is the filtering behavior below, not the mapping behavior,
+	// that decides whether this remote may use it.
 	var pub2priKey interface{}
+	var remoteAddr4 types.IPv4Address
+	var remoteAddr6 types.IPv6Address
 	if pktIPv4 != nil {
+		remoteAddr4 = packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr)
 		pub2priKey = Tuple{
 			addr: packet.SwapBytesIPv4Addr(pktIPv4.DstAddr),
 			port: portNumber,
 		}
 	} else {
+		remoteAddr6 = pktIPv6.SrcAddr
 		pub2priKey = Tuple6{
 			addr: pktIPv6.DstAddr,
 			port: portNumber,
@@ -119,6 +143,15 @@ func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 			port.dumpPacket(pkt, DirDROP)
 			return DirDROP
 		}
+
+		// An external client probing its own NAT type: answer with the
+		// (IP, port) this packet was observed with, unmodified.
+		if port.StunPort != 0 && portNumber == port.StunPort {
+			if handleSTUNBindingRequest(pkt, pktIPv4, pktIPv6, pktUDP, ipv6, remoteAddr4, remoteAddr6, SrcPort) {
+				port.dumpPacket(pkt, DirPublicLoop)
+				return DirPublicLoop
+			}
+		}
 	}
 
 	// Do lookup
@@ -166,6 +199,13 @@ func PublicToPrivateTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 		return DirDROP
 	}
 
+	// RFC 4787 filtering: drop packets from remotes the mapping's
+	// FilteringBehavior hasn't previously seen traffic sent to.
+	if !portmap[portNumber].allowedRemotes.check(ipv6, remoteAddr4, remoteAddr6, SrcPort) {
+		port.dumpPacket(pkt, DirDROP)
+		return DirDROP
+	}
+
 	if !zeroAddr {
 		// Check whether TCP connection could be reused
 		if pktTCP != nil && !portmap[portNumber].static {
@@ -220,25 +260,41 @@ func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 		return dir
 	}
 
-	protocol, pktTCP, pktUDP, pktICMP, SrcPort, _ := ParseAllKnownL4(pkt, pktIPv4, pktIPv6)
+	// See the equivalent check in PublicToPrivateTranslation: buffer
+	// every fragment, the first included, until the datagram is whole.
+	if pktIPv4 != nil && isIPv4Fragment(pktIPv4) {
+		reassembled, complete := port.reassembleFragment(pktIPv4, pkt.GetPacketPayload())
+		if !complete {
+			port.dumpPacket(pkt, DirDROP)
+			return DirDROP
+		}
+		if !applyReassembledIPv4Payload(pkt, pktIPv4, reassembled) {
+			port.dumpPacket(pkt, DirDROP)
+			return DirDROP
+		}
+	}
+
+	protocol, pktTCP, pktUDP, pktICMP, SrcPort, DstPort := ParseAllKnownL4(pkt, pktIPv4, pktIPv6)
 	if protocol == 0 {
 		// Only TCP, UDP and ICMP are supported now, all other protocols are ignored
 		port.dumpPacket(pkt, DirDROP)
 		return DirDROP
 	}
 	portNumber := SrcPort
-	// Create a lookup key from packet source address and port
+	// Create a lookup key from packet source address and port. Whether
+	// the destination is folded into the key depends on the port
+	// pair's MappingBehavior (RFC 4787 section 4.1); with the default
+	// EndpointIndependentMapping it is ignored, reproducing the
+	// original (addr, port)-only key.
 	var pri2pubKey interface{}
+	var remoteAddr4 types.IPv4Address
+	var remoteAddr6 types.IPv6Address
 	if pktIPv4 != nil {
-		pri2pubKey = Tuple{
-			addr: packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr),
-			port: portNumber,
-		}
+		remoteAddr4 = packet.SwapBytesIPv4Addr(pktIPv4.DstAddr)
+		pri2pubKey = makeMappingKey(pp.MappingBehavior, packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr), portNumber, remoteAddr4, DstPort)
 	} else {
-		pri2pubKey = Tuple6{
-			addr: pktIPv6.SrcAddr,
-			port: portNumber,
-		}
+		remoteAddr6 = pktIPv6.DstAddr
+		pri2pubKey = makeMappingKey6(pp.MappingBehavior, pktIPv6.SrcAddr, portNumber, remoteAddr6, DstPort)
 	}
 	// Check for ICMP traffic first
 	if pktICMP != nil {
@@ -261,6 +317,67 @@ func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 			port.dumpPacket(pkt, DirDROP)
 			return DirDROP
 		}
+
+		// A private host querying its own allocated public mapping,
+		// e.g. to use it for ICE-style peer discovery. Under Address-
+		// Dependent/Address-and-Port-Dependent mapping, pri2pubKey's
+		// remote is this packet's destination, which is the NAT's own
+		// public STUN address, not a real peer, so looking up pri2pubKey
+		// directly would report a synthetic mapping real traffic to an
+		// actual peer will never reuse. Instead report whatever real
+		// mapping this private (addr, port) most recently used, under
+		// any remote, so the answer reflects actual NAT behavior;
+		// only if there isn't one yet is a fresh EIM-keyed mapping
+		// allocated as a placeholder.
+		targetsPublic := remoteAddr4 == pp.PublicPort.Subnet.Addr
+		if ipv6 {
+			targetsPublic = pp.PublicPort.ownsIPv6Address(remoteAddr6)
+		}
+		if pp.PublicPort.StunPort != 0 && DstPort == pp.PublicPort.StunPort && targetsPublic {
+			var privAddr4 types.IPv4Address
+			var privAddr6 types.IPv6Address
+			if ipv6 {
+				privAddr6 = pktIPv6.SrcAddr
+			} else {
+				privAddr4 = packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr)
+			}
+			var pubV4 types.IPv4Address
+			var pubV6 types.IPv6Address
+			var pubPort uint16
+			if v, found := pp.findMostRecentMapping(ipv6, protocol, privAddr4, privAddr6, portNumber); found {
+				pubV4, pubV6, pubPort, _ = getAddrFromTuple(v, ipv6)
+			} else {
+				var stunKey interface{}
+				if ipv6 {
+					stunKey = makeMappingKey6(EndpointIndependentMapping, pktIPv6.SrcAddr, portNumber, types.IPv6Address{}, 0)
+				} else {
+					stunKey = makeMappingKey(EndpointIndependentMapping, packet.SwapBytesIPv4Addr(pktIPv4.SrcAddr), portNumber, 0, 0)
+				}
+				var err error
+				pubV4, pubV6, pubPort, err = pp.allocateNewEgressConnection(ipv6, protocol, stunKey, privAddr6, types.IPv6Address{}, 0)
+				if err != nil {
+					println("Warning! Failed to allocate new connection for STUN query", err)
+					port.dumpPacket(pkt, DirDROP)
+					return DirDROP
+				}
+			}
+			if handleSTUNBindingRequest(pkt, pktIPv4, pktIPv6, pktUDP, ipv6, pubV4, pubV6, pubPort) {
+				port.dumpPacket(pkt, DirPrivateLoop)
+				return DirPrivateLoop
+			}
+		}
+	}
+
+	// Hairpinning: a private host may reach another private host
+	// through the NAT's public mapping for it, e.g. after discovering
+	// it via STUN. Detect that before treating the destination as
+	// external.
+	if pp.HairpinMode != HairpinOff {
+		if target, found := pp.findHairpinTarget(ipv6, protocol, remoteAddr4, remoteAddr6, DstPort); found {
+			if pp.HairpinMode == HairpinFull || samePrivateHost(ipv6, pri2pubKey, target) {
+				return pp.hairpinTranslate(pkt, ipv6, protocol, pri2pubKey, target, pktVLAN, pktIPv4, pktIPv6, pktTCP, pktUDP, pktICMP)
+			}
+		}
 	}
 
 	kniPresent := port.KNIName != ""
@@ -310,8 +427,12 @@ func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 			return DirDROP
 		}
 		var err error
+		var privAddr6 types.IPv6Address
+		if pktIPv6 != nil {
+			privAddr6 = pktIPv6.SrcAddr
+		}
 		// Allocate new connection from private to public network
-		v4addr, v6addr, newPort, err = pp.allocateNewEgressConnection(pktIPv6 != nil, protocol, pri2pubKey)
+		v4addr, v6addr, newPort, err = pp.allocateNewEgressConnection(pktIPv6 != nil, protocol, pri2pubKey, privAddr6, remoteAddr6, DstPort)
 
 		if err != nil {
 			println("Warning! Failed to allocate new connection", err)
@@ -324,6 +445,10 @@ func PrivateToPublicTranslation(pkt *packet.Packet, ctx flow.UserContext) uint {
 		pp.PublicPort.getPortmap(ipv6, protocol)[newPort].lastused = time.Now()
 	}
 
+	// Record this remote as legitimate for the mapping's filtering
+	// behavior, so the corresponding inbound reply is allowed back in.
+	pp.PublicPort.getPortmap(ipv6, protocol)[newPort].allowedRemotes.allow(ipv6, remoteAddr4, remoteAddr6, DstPort)
+
 	if !zeroAddr {
 		// Check whether TCP connection could be reused
 		if pktTCP != nil && !pp.PublicPort.getPortmap(ipv6, protocol)[newPort].static {
@@ -422,12 +547,71 @@ func (port *ipPort) parsePacketAndCheckARP(pkt *packet.Packet) (dir uint, vlanhd
 	return DirSEND, pktVLAN, pktIPv4, nil
 }
 
+// getAddrFromTuple extracts the (addr, port) a translation table entry
+// points to. The public port's table stores the private side's entry
+// as its value (a mappingKey/mappingKey6, built from pri2pubKey) while
+// the private port's table stores the public side's (a plain
+// Tuple/Tuple6), so both shapes have to be handled here depending on
+// which port's table v was loaded from.
 func getAddrFromTuple(v interface{}, ipv6 bool) (types.IPv4Address, types.IPv6Address, uint16, bool) {
 	if ipv6 {
-		value := v.(Tuple6)
-		return 0, value.addr, value.port, value.addr == types.IPv6Address{}
-	} else {
-		value := v.(Tuple)
+		switch value := v.(type) {
+		case Tuple6:
+			return 0, value.addr, value.port, value.addr == types.IPv6Address{}
+		case mappingKey6:
+			return 0, value.addr, value.port, value.addr == types.IPv6Address{}
+		}
+		return 0, types.IPv6Address{}, 0, true
+	}
+	switch value := v.(type) {
+	case Tuple:
+		return value.addr, types.IPv6Address{}, value.port, value.addr == 0
+	case mappingKey:
 		return value.addr, types.IPv6Address{}, value.port, value.addr == 0
 	}
+	return 0, types.IPv6Address{}, 0, true
+}
+
+// findMostRecentMapping returns the most recently used existing
+// mapping for the private (addr, port) on the private port's
+// translationTable, regardless of which remote it was keyed against
+// under the port pair's MappingBehavior, along with the public
+// (addr, port) it maps to. Used by the STUN self-query responder: a
+// synthetic, specially-keyed lookup can't find a mapping keyed to a
+// real peer under Address-Dependent/Address-and-Port-Dependent
+// mapping, so this scans for whatever mapping traffic actually
+// created instead.
+func (pp *portPair) findMostRecentMapping(ipv6 bool, protocol uint8, privAddr4 types.IPv4Address, privAddr6 types.IPv6Address, privPort uint16) (interface{}, bool) {
+	portmap := pp.getPublicPortPortmap(ipv6, protocol)
+	var best interface{}
+	var bestTime time.Time
+	pp.PrivatePort.translationTable[protocol].Range(func(k, v interface{}) bool {
+		var addr4 types.IPv4Address
+		var addr6 types.IPv6Address
+		var port uint16
+		switch key := k.(type) {
+		case mappingKey:
+			addr4, port = key.addr, key.port
+		case mappingKey6:
+			addr6, port = key.addr, key.port
+		default:
+			return true
+		}
+		if port != privPort {
+			return true
+		}
+		if ipv6 {
+			if addr6 != privAddr6 {
+				return true
+			}
+		} else if addr4 != privAddr4 {
+			return true
+		}
+		_, _, pubPort, _ := getAddrFromTuple(v, ipv6)
+		if t := portmap[pubPort].lastused; best == nil || t.After(bestTime) {
+			best, bestTime = v, t
+		}
+		return true
+	})
+	return best, best != nil
 }
@@ -0,0 +1,450 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/intel-go/nff-go/flow"
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+)
+
+// Splitter output directions. DirSEND forwards the packet out the
+// opposite port from the one it arrived on (the ordinary translation
+// path); DirDROP discards it; DirKNI hands it to the port's KNI
+// interface for the host OS to handle. DirPrivateLoop and
+// DirPublicLoop (hairpin.go, stun.go) extend this sequence for traffic
+// the NAT loops back out the port it arrived on.
+const (
+	DirSEND = uint(0)
+	DirDROP = uint(1)
+	DirKNI  = uint(2)
+)
+
+// connectionTimeout is how long a mapping may sit idle before
+// PublicToPrivateTranslation stops translating for it: the next
+// inbound packet that finds it idle for longer than this releases its
+// port through deleteOldConnection. allocNewPort does not check it, so
+// an idle mapping that sees no further inbound packet keeps its port.
+const connectionTimeout = 60 * time.Second
+
+// portReuseSetLastusedTime is how far into the future
+// checkTCPTermination sets a just-closed mapping's lastused. The
+// non-zero lastused keeps the port out of allocNewPort's free-port
+// scan, which only takes zeroed entries, so a delayed retransmission
+// of the old connection's last packets can't be confused with a new
+// one that reused the same port immediately. The port is free again
+// only once deleteOldConnection zeroes the entry, i.e. when an inbound
+// packet finds it idle for longer than connectionTimeout past that
+// point.
+const portReuseSetLastusedTime = 10 * time.Second
+
+// minEphemeralPort is the first port allocNewPort will hand out;
+// ports below it are reserved the way a host's own ephemeral port
+// range is.
+const minEphemeralPort = 1024
+
+// terminationDirection records which side of a TCP connection sent
+// the first FIN, so checkTCPTermination can recognize a FIN from the
+// other side as the second leg of a clean close. It is represented so
+// that the "other direction" is always ^dir: pub2pri and pri2pub are
+// bitwise complements of one another rather than small sequential
+// integers.
+type terminationDirection uint8
+
+const (
+	pub2pri terminationDirection = 0
+	pri2pub terminationDirection = ^terminationDirection(0)
+)
+
+// pairIndex is the flow.UserContext PublicToPrivateTranslation and
+// PrivateToPublicTranslation receive for every packet: just enough to
+// find this flow's portPair in Natconfig.PortPairs without copying it.
+type pairIndex struct {
+	index int
+}
+
+// Copy satisfies flow.UserContext. pairIndex has no per-core state of
+// its own, so copying it is just copying the index.
+func (pi pairIndex) Copy() flow.UserContext {
+	return pi
+}
+
+// NatConfiguration holds every port pair this NAT instance translates
+// between.
+type NatConfiguration struct {
+	PortPairs []portPair
+}
+
+// Natconfig is the running NAT configuration, populated from JSON
+// configuration at startup (or, under nat/vnet, built in memory by
+// NewVirtualPortPair).
+var Natconfig NatConfiguration
+
+// portPair is one NAT instance: a public-facing ipPort and a
+// private-facing ipPort sharing a translation table and RFC 4787
+// behavior configuration.
+type portPair struct {
+	mutex sync.Mutex
+
+	PublicPort  ipPort
+	PrivatePort ipPort
+
+	MappingBehavior   MappingBehavior
+	FilteringBehavior FilteringBehavior
+	HairpinMode       HairpinMode
+}
+
+// ipPort is one side (public or private) of a portPair: its own
+// address configuration, ARP cache, and per-protocol translation
+// state.
+type ipPort struct {
+	Subnet  ipSubnet
+	Subnet6 ipSubnet6
+
+	KNIName       string
+	SrcMACAddress types.MACAddress
+	Vlan          uint16
+	// StunPort is the UDP port this port answers STUN Binding Requests
+	// on; 0 disables the responder (see stun.go).
+	StunPort uint16
+
+	arpTable         sync.Map
+	translationTable [256]sync.Map
+	portmapsV4       [256][]portMapEntry
+	portmapsV6       [256][]portMapEntry
+	// fragments buffers IPv4 fragments arriving on this port until
+	// they can be reassembled into a complete datagram (fragment.go).
+	fragments *fragmentReassembler
+
+	// opposite is the other ipPort in this port's portPair: the
+	// private port's opposite is its pair's public port and vice
+	// versa. Translation rewrites a packet's destination MAC/VLAN
+	// using opposite's, since that's the interface it leaves on.
+	opposite *ipPort
+}
+
+// ipSubnet is an ipPort's IPv4 address configuration.
+type ipSubnet struct {
+	Addr            types.IPv4Address
+	addressAcquired bool
+}
+
+// ipSubnet6 is an ipPort's IPv6 address configuration: a primary
+// address plus, once more than one egress address is configured (e.g.
+// via a DHCPv6-PD delegation wider than a single /128), a Pool
+// selectEgressAddr6 (subnet6pool.go) can choose from.
+type ipSubnet6 struct {
+	Addr            types.IPv6Address
+	addressAcquired bool
+	llAddr          types.IPv6Address
+	multicastAddr   types.IPv6Address
+	llMulticastAddr types.IPv6Address
+
+	Pool             []addressPoolEntry
+	AddressSelection AddressSelectionPolicy
+	rrCounter        uint32
+}
+
+// portMapEntry is one allocated public (protocol, port) mapping. A
+// zero-value entry (zero lastused) means the port is free.
+type portMapEntry struct {
+	lastused             time.Time
+	finCount             int
+	terminationDirection terminationDirection
+	static               bool
+
+	// allowedRemotes tracks which remotes the mapping's
+	// FilteringBehavior permits to reach it; nil on a free entry, in
+	// which case allow/check treat it as EndpointIndependentFiltering.
+	allowedRemotes *allowedRemoteSet
+}
+
+// getPortmap returns this port's 65536-entry portMapEntry table for
+// protocol, allocating it on first use. IPv4 and IPv6 traffic get
+// separate tables so a busy IPv4 flow can't starve ephemeral ports an
+// IPv6 flow needs, and vice versa.
+func (port *ipPort) getPortmap(ipv6 bool, protocol uint8) []portMapEntry {
+	table := &port.portmapsV4
+	if ipv6 {
+		table = &port.portmapsV6
+	}
+	if table[protocol] == nil {
+		table[protocol] = make([]portMapEntry, 1<<16)
+	}
+	return table[protocol]
+}
+
+// getPublicPortPortmap is the portmap new mappings are allocated from
+// and aged out of: always the public port's, since that's where the
+// (protocol, port) namespace is actually shared with the outside
+// world.
+func (pp *portPair) getPublicPortPortmap(ipv6 bool, protocol uint8) []portMapEntry {
+	return pp.PublicPort.getPortmap(ipv6, protocol)
+}
+
+// allocNewPort finds a free public port for protocol, scanning from
+// minEphemeralPort. A portMapEntry is free if it has never been used
+// or was released by deleteOldConnection.
+func (pp *portPair) allocNewPort(ipv6 bool, protocol uint8) (int, error) {
+	portmap := pp.getPublicPortPortmap(ipv6, protocol)
+	for i := minEphemeralPort; i < len(portmap); i++ {
+		if portmap[i].lastused.IsZero() {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ports available for protocol %d", protocol)
+}
+
+// deleteOldConnection releases port back to allocNewPort. It does not
+// eagerly clear the corresponding translationTable entries; those are
+// simply overwritten the next time the port is reused.
+func (pp *portPair) deleteOldConnection(ipv6 bool, protocol uint8, port int) {
+	pp.getPublicPortPortmap(ipv6, protocol)[port] = portMapEntry{}
+}
+
+// getMACForIPv4 looks up the MAC address this port last saw addr (a
+// host-order address, as returned by getAddrFromTuple) using from.
+func (port *ipPort) getMACForIPv4(addr types.IPv4Address) (types.MACAddress, bool) {
+	v, found := port.arpTable.Load(packet.SwapBytesIPv4Addr(addr))
+	if !found {
+		return types.MACAddress{}, false
+	}
+	return v.(types.MACAddress), true
+}
+
+// getMACForIPv6 is getMACForIPv4's IPv6 counterpart.
+func (port *ipPort) getMACForIPv6(addr types.IPv6Address) (types.MACAddress, bool) {
+	v, found := port.arpTable.Load(addr)
+	if !found {
+		return types.MACAddress{}, false
+	}
+	return v.(types.MACAddress), true
+}
+
+// dumpPacket is a hook for optional packet-level debug tracing of dir,
+// the direction a packet was routed to. It is a no-op in this build;
+// debug builds wire it up to a pcap writer keyed by port/direction.
+func (port *ipPort) dumpPacket(pkt *packet.Packet, dir uint) {
+}
+
+// handleARP answers or records an ARP packet arriving on this port,
+// returning the direction it should be routed to.
+func (port *ipPort) handleARP(pkt *packet.Packet) uint {
+	arp := pkt.GetARPNoCheck()
+	if arp == nil {
+		return DirDROP
+	}
+	port.arpTable.Store(arp.SPA, arp.SHA)
+	if port.KNIName != "" {
+		return DirKNI
+	}
+	return DirDROP
+}
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpv6ServerPort = 547
+	dhcpv6ClientPort = 546
+)
+
+// dhcpYiaddrOffset is the "your (client) IP address" field's fixed
+// offset into a BOOTP/DHCP message (RFC 2131 section 2): 1 byte op, 1
+// byte htype, 1 byte hlen, 1 byte hops, 4 bytes xid, 2 bytes secs, 2
+// bytes flags, 4 bytes ciaddr, then yiaddr.
+const dhcpYiaddrOffset = 16
+
+// handleDHCP reports whether pkt is IPv4 DHCP traffic (client <-> server
+// port 67/68), which this port consumes itself rather than translating.
+// A server reply's yiaddr is adopted as this port's own Subnet.Addr,
+// the same address acquisition a real DHCP client would perform
+// against a lease (relevant on the public port of a NAT whose own
+// external address comes from an upstream DHCP server).
+func (port *ipPort) handleDHCP(pkt *packet.Packet) bool {
+	udp := pkt.GetUDPNoCheck()
+	if udp == nil {
+		return false
+	}
+	sp := packet.SwapBytesUint16(udp.SrcPort)
+	dp := packet.SwapBytesUint16(udp.DstPort)
+	if sp == dhcpServerPort && dp == dhcpClientPort {
+		if payload := pkt.GetPacketPayload(); len(payload) >= dhcpYiaddrOffset+4 {
+			if yiaddr := types.IPv4Address(binary.BigEndian.Uint32(payload[dhcpYiaddrOffset : dhcpYiaddrOffset+4])); yiaddr != 0 {
+				port.Subnet.Addr = yiaddr
+				port.Subnet.addressAcquired = true
+			}
+		}
+		return true
+	}
+	return sp == dhcpClientPort && dp == dhcpServerPort
+}
+
+// handleDHCPv6 is handleDHCP's IPv6 counterpart (port 546/547).
+func (port *ipPort) handleDHCPv6(pkt *packet.Packet) bool {
+	udp := pkt.GetUDPNoCheck()
+	if udp == nil {
+		return false
+	}
+	sp := packet.SwapBytesUint16(udp.SrcPort)
+	dp := packet.SwapBytesUint16(udp.DstPort)
+	return (sp == dhcpv6ServerPort && dp == dhcpv6ClientPort) || (sp == dhcpv6ClientPort && dp == dhcpv6ServerPort)
+}
+
+// icmpErrorHeaderLen is the fixed part of an ICMP error message ahead
+// of the embedded original datagram: 1 byte type, 1 byte code, 2
+// bytes checksum, 4 bytes type-specific (RFC 792).
+const icmpErrorHeaderLen = 8
+
+// embeddedIPv4Header casts the start of an ICMP error message's
+// payload to the original IPv4 header RFC 792 says it embeds, the
+// same way ipv4PayloadBytes reaches into a real header's trailing
+// bytes.
+func embeddedIPv4Header(payload []byte) *packet.IPv4Hdr {
+	if len(payload) < ipv4MinHeaderLen {
+		return nil
+	}
+	return (*packet.IPv4Hdr)(unsafe.Pointer(&payload[0]))
+}
+
+// ipv4MinHeaderLen is the smallest legal IPv4 header: 20 bytes with no
+// options.
+const ipv4MinHeaderLen = 20
+
+// icmpv6TypeNeighborSolicitation is the ICMPv6 type for a Neighbor
+// Solicitation (RFC 4861 section 4.3).
+const icmpv6TypeNeighborSolicitation = 135
+
+// icmpv6NeighborSolicitationTarget extracts the Target Address field
+// of an ICMPv6 Neighbor Solicitation: 4 reserved bytes followed by a
+// 16-byte IPv6 address in the ICMP payload.
+func icmpv6NeighborSolicitationTarget(pkt *packet.Packet) (types.IPv6Address, bool) {
+	const reservedLen = 4
+	payload := pkt.GetPacketPayload()
+	if len(payload) < reservedLen+16 {
+		return types.IPv6Address{}, false
+	}
+	var target types.IPv6Address
+	copy(target[:], payload[reservedLen:reservedLen+16])
+	return target, true
+}
+
+// handleICMP inspects ICMP traffic arriving on port, returning
+// DirSEND to let it fall through to ordinary key-based translation
+// unless it needs different handling. ICMP error messages embed the
+// original datagram that triggered them; if that embedded datagram is
+// itself an IPv4 fragment (first or later), the bytes the error echoes
+// are fed through this port's own fragmentReassembler, and the error
+// is dropped (DirDROP) unless they complete the embedded datagram. The
+// reassembled bytes are not used further: handleICMP does not rewrite
+// the embedded header or its ports.
+func (port *ipPort) handleICMP(protocol uint8, pkt *packet.Packet, key interface{}) uint {
+	icmp := pkt.GetICMPNoCheck()
+	if icmp == nil {
+		return DirSEND
+	}
+
+	switch icmp.Type {
+	case types.ICMPTypeEchoRequest, types.ICMPTypeEchoReply:
+		return DirSEND
+	case icmpv6TypeNeighborSolicitation:
+		// NDP (RFC 4861) is handled by this port directly, the same
+		// way ARP is: a solicitation for an address this port owns -
+		// its primary Subnet6.Addr or any address acquired into
+		// Subnet6.Pool - is answered locally rather than translated.
+		if target, ok := icmpv6NeighborSolicitationTarget(pkt); ok && port.ownsIPv6Address(target) {
+			return DirKNI
+		}
+		return DirDROP
+	case types.ICMPTypeDestinationUnreachable, types.ICMPTypeTimeExceeded:
+		payload := pkt.GetPacketPayload()
+		if len(payload) <= icmpErrorHeaderLen {
+			return DirSEND
+		}
+		errData := payload[icmpErrorHeaderLen:]
+		embedded := embeddedIPv4Header(errData)
+		if embedded == nil {
+			return DirSEND
+		}
+		if _, ok := port.reassembleEmbeddedFragment(embedded, ipv4PayloadBytes(embedded, len(errData))); !ok {
+			return DirDROP
+		}
+		return DirSEND
+	default:
+		return DirSEND
+	}
+}
+
+// ParseAllKnownL4 parses pkt's L4 header for the protocols this NAT
+// translates (TCP, UDP, ICMP and ICMPv6), returning the IP protocol number and
+// whichever of pktTCP/pktUDP/pktICMP applies, plus the packet's source
+// and destination ports (both the ICMP Identifier for ICMP, which has
+// no ports of its own). protocol is 0 if pkt carries an L4 protocol
+// this NAT doesn't handle, or if the expected header failed to parse.
+func ParseAllKnownL4(pkt *packet.Packet, pktIPv4 *packet.IPv4Hdr, pktIPv6 *packet.IPv6Hdr) (protocol uint8, pktTCP *packet.TCPHdr, pktUDP *packet.UDPHdr, pktICMP *packet.ICMPHdr, srcPort, dstPort uint16) {
+	if pktIPv4 != nil {
+		protocol = pktIPv4.NextProtoID
+	} else {
+		protocol = pktIPv6.NextHeader
+	}
+
+	switch protocol {
+	case types.TCPNumber:
+		pktTCP = pkt.GetTCPNoCheck()
+		if pktTCP == nil {
+			return 0, nil, nil, nil, 0, 0
+		}
+		srcPort = packet.SwapBytesUint16(pktTCP.SrcPort)
+		dstPort = packet.SwapBytesUint16(pktTCP.DstPort)
+	case types.UDPNumber:
+		pktUDP = pkt.GetUDPNoCheck()
+		if pktUDP == nil {
+			return 0, nil, nil, nil, 0, 0
+		}
+		srcPort = packet.SwapBytesUint16(pktUDP.SrcPort)
+		dstPort = packet.SwapBytesUint16(pktUDP.DstPort)
+	case types.ICMPNumber, types.ICMPv6Number:
+		pktICMP = pkt.GetICMPNoCheck()
+		if pktICMP == nil {
+			return 0, nil, nil, nil, 0, 0
+		}
+		srcPort = packet.SwapBytesUint16(pktICMP.Identifier)
+		dstPort = srcPort
+	default:
+		return 0, nil, nil, nil, 0, 0
+	}
+	return protocol, pktTCP, pktUDP, pktICMP, srcPort, dstPort
+}
+
+// setPacketSrcPort rewrites pkt's source port (or ICMP Identifier) to
+// port, whichever of pktTCP/pktUDP/pktICMP is non-nil.
+func setPacketSrcPort(pkt *packet.Packet, ipv6 bool, port uint16, pktTCP *packet.TCPHdr, pktUDP *packet.UDPHdr, pktICMP *packet.ICMPHdr) {
+	switch {
+	case pktTCP != nil:
+		pktTCP.SrcPort = packet.SwapBytesUint16(port)
+	case pktUDP != nil:
+		pktUDP.SrcPort = packet.SwapBytesUint16(port)
+	case pktICMP != nil:
+		pktICMP.Identifier = packet.SwapBytesUint16(port)
+	}
+}
+
+// setPacketDstPort is setPacketSrcPort's destination-side counterpart.
+func setPacketDstPort(pkt *packet.Packet, ipv6 bool, port uint16, pktTCP *packet.TCPHdr, pktUDP *packet.UDPHdr, pktICMP *packet.ICMPHdr) {
+	switch {
+	case pktTCP != nil:
+		pktTCP.DstPort = packet.SwapBytesUint16(port)
+	case pktUDP != nil:
+		pktUDP.DstPort = packet.SwapBytesUint16(port)
+	case pktICMP != nil:
+		pktICMP.Identifier = packet.SwapBytesUint16(port)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vnet
+
+import (
+	"encoding/binary"
+
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+)
+
+// UDPPacket builds a minimal Ethernet+IPv4+UDP packet using the
+// existing packet package's construction helpers, for feeding into a
+// Harness.
+func UDPPacket(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, srcPort, dstPort uint16, payload []byte) *packet.Packet {
+	pkt, err := packet.NewPacket()
+	if err != nil {
+		panic(err)
+	}
+	packet.InitEmptyIPv4UDPPacket(pkt, uint(len(payload)))
+	pkt.Ether.SAddr = srcMAC
+	pkt.Ether.DAddr = dstMAC
+	ipv4 := pkt.GetIPv4NoCheck()
+	ipv4.SrcAddr = packet.SwapBytesIPv4Addr(srcIP)
+	ipv4.DstAddr = packet.SwapBytesIPv4Addr(dstIP)
+	udp := pkt.GetUDPNoCheck()
+	udp.SrcPort = packet.SwapBytesUint16(srcPort)
+	udp.DstPort = packet.SwapBytesUint16(dstPort)
+	copy(pkt.GetPacketPayload(), payload)
+	return pkt
+}
+
+// TCPPacket builds a minimal Ethernet+IPv4+TCP packet with the given
+// flags (types.TCPFlagSyn, types.TCPFlagAck, types.TCPFlagFin, ...).
+func TCPPacket(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, srcPort, dstPort uint16, flags uint8) *packet.Packet {
+	pkt, err := packet.NewPacket()
+	if err != nil {
+		panic(err)
+	}
+	packet.InitEmptyIPv4TCPPacket(pkt, 0)
+	pkt.Ether.SAddr = srcMAC
+	pkt.Ether.DAddr = dstMAC
+	ipv4 := pkt.GetIPv4NoCheck()
+	ipv4.SrcAddr = packet.SwapBytesIPv4Addr(srcIP)
+	ipv4.DstAddr = packet.SwapBytesIPv4Addr(dstIP)
+	tcp := pkt.GetTCPNoCheck()
+	tcp.SrcPort = packet.SwapBytesUint16(srcPort)
+	tcp.DstPort = packet.SwapBytesUint16(dstPort)
+	tcp.TCPFlags = flags
+	return pkt
+}
+
+// DHCPAckPacket builds a minimal Ethernet+IPv4+UDP DHCP server-to-client
+// reply (server port 67 -> client port 68) carrying yiaddr, the "your
+// IP address" field a real lease would hand back, for exercising
+// handleDHCP's address-acquisition path.
+func DHCPAckPacket(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, yiaddr types.IPv4Address) *packet.Packet {
+	payload := make([]byte, 20)
+	binary.BigEndian.PutUint32(payload[16:20], uint32(yiaddr))
+	return UDPPacket(srcMAC, dstMAC, srcIP, dstIP, 67, 68, payload)
+}
+
+// IPv4Fragments splits a UDP datagram from srcIP:srcPort to
+// dstIP:dstPort into two raw IPv4 fragments at offset (which must be a
+// multiple of 8, per RFC 791): the first carries the UDP header and
+// the payload up to offset with MF=1, the second carries the
+// remaining payload with MF=0 and no L4 header of its own, mirroring
+// how a real sender's fragmentation (and SendWithRefragmentation's own
+// re-fragmentation) lays out everything after the IPv4 header as raw
+// bytes once a datagram no longer fits in one piece.
+func IPv4Fragments(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, srcPort, dstPort uint16, payload []byte, offset int) (*packet.Packet, *packet.Packet) {
+	const udpHeaderLen = 8
+	datagram := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(datagram[0:2], srcPort)
+	binary.BigEndian.PutUint16(datagram[2:4], dstPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(udpHeaderLen+len(payload)))
+	copy(datagram[udpHeaderLen:], payload)
+
+	const id = 1234
+	first := rawIPv4Fragment(srcMAC, dstMAC, srcIP, dstIP, id, 0, true, datagram[:offset])
+	second := rawIPv4Fragment(srcMAC, dstMAC, srcIP, dstIP, id, offset, false, datagram[offset:])
+	return first, second
+}
+
+// rawIPv4Fragment builds a bare Ethernet+IPv4 packet with no parsed L4
+// header, carrying data as the literal bytes following the IPv4
+// header, exactly as any fragment other than a datagram's first
+// really looks on the wire.
+func rawIPv4Fragment(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, id uint16, fragOffset int, moreFragments bool, data []byte) *packet.Packet {
+	pkt, err := packet.NewPacket()
+	if err != nil {
+		panic(err)
+	}
+	packet.InitEmptyIPv4Packet(pkt, uint(len(data)))
+	pkt.Ether.SAddr = srcMAC
+	pkt.Ether.DAddr = dstMAC
+	ipv4 := pkt.GetIPv4NoCheck()
+	ipv4.SrcAddr = packet.SwapBytesIPv4Addr(srcIP)
+	ipv4.DstAddr = packet.SwapBytesIPv4Addr(dstIP)
+	ipv4.NextProtoID = types.UDPNumber
+	ipv4.PacketID = packet.SwapBytesUint16(id)
+	flagsAndOffset := uint16(fragOffset / 8)
+	if moreFragments {
+		flagsAndOffset |= 0x2000
+	}
+	ipv4.FragmentOffset = packet.SwapBytesUint16(flagsAndOffset)
+	hdrLen := int(ipv4.VersionIhl&0x0f) * 4
+	ipv4.TotalLength = packet.SwapBytesUint16(uint16(hdrLen + len(data)))
+	copy(pkt.GetPacketPayload(), data)
+	return pkt
+}
+
+// STUNBindingRequestPacket builds a minimal Ethernet+IPv4+UDP STUN
+// (RFC 5389) Binding Request with txID as its transaction ID and no
+// attributes, for exercising the STUN responder.
+func STUNBindingRequestPacket(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, srcPort, dstPort uint16, txID [12]byte) *packet.Packet {
+	const (
+		stunBindingRequest = 0x0001
+		stunMagicCookie    = 0x2112A442
+	)
+	body := make([]byte, 20)
+	binary.BigEndian.PutUint16(body[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(body[4:8], stunMagicCookie)
+	copy(body[8:20], txID[:])
+	return UDPPacket(srcMAC, dstMAC, srcIP, dstIP, srcPort, dstPort, body)
+}
+
+// ParseSTUNXorMappedAddressIPv4 decodes the IPv4 XOR-MAPPED-ADDRESS
+// attribute from a STUN message body (the UDP payload of a response
+// built by handleSTUNBindingRequest), returning the address/port it
+// carries.
+func ParseSTUNXorMappedAddressIPv4(resp []byte) (addr types.IPv4Address, port uint16, ok bool) {
+	const (
+		stunHeaderLen   = 20
+		stunMagicCookie = 0x2112A442
+	)
+	if len(resp) < stunHeaderLen+8 {
+		return 0, 0, false
+	}
+	attr := resp[stunHeaderLen+4:]
+	port = binary.BigEndian.Uint16(attr[2:4]) ^ uint16(stunMagicCookie>>16)
+	addr = types.IPv4Address(binary.BigEndian.Uint32(attr[4:8]) ^ stunMagicCookie)
+	return addr, port, true
+}
+
+// ICMPEchoPacket builds a minimal Ethernet+IPv4+ICMP echo request.
+func ICMPEchoPacket(srcMAC, dstMAC types.MACAddress, srcIP, dstIP types.IPv4Address, id, seq uint16) *packet.Packet {
+	pkt, err := packet.NewPacket()
+	if err != nil {
+		panic(err)
+	}
+	packet.InitEmptyIPv4ICMPPacket(pkt, 0)
+	pkt.Ether.SAddr = srcMAC
+	pkt.Ether.DAddr = dstMAC
+	ipv4 := pkt.GetIPv4NoCheck()
+	ipv4.SrcAddr = packet.SwapBytesIPv4Addr(srcIP)
+	ipv4.DstAddr = packet.SwapBytesIPv4Addr(dstIP)
+	icmp := pkt.GetICMPNoCheck()
+	icmp.Type = types.ICMPTypeEchoRequest
+	icmp.Identifier = packet.SwapBytesUint16(id)
+	icmp.SequenceNumber = packet.SwapBytesUint16(seq)
+	return pkt
+}
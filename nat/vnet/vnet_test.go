@@ -0,0 +1,282 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vnet
+
+import (
+	"testing"
+
+	"github.com/intel-go/nff-go/packet"
+	"github.com/intel-go/nff-go/types"
+
+	"github.com/intel-go/nff-go-nat/nat"
+)
+
+var (
+	publicMAC  = types.MACAddress{0x00, 0x11, 0x22, 0x33, 0x44, 0x01}
+	privateMAC = types.MACAddress{0x00, 0x11, 0x22, 0x33, 0x44, 0x02}
+	peerMAC    = types.MACAddress{0x00, 0x11, 0x22, 0x33, 0x44, 0x03}
+
+	publicIP  = types.IPv4Address(0x01020304) // 1.2.3.4
+	privateIP = types.IPv4Address(0x0a000001) // 10.0.0.1
+	remoteIP  = types.IPv4Address(0x05060708) // 5.6.7.8
+	remoteIP2 = types.IPv4Address(0x05060709) // 5.6.7.9
+)
+
+// TestMappingFilteringMatrix exercises the RFC 4787 mapping/filtering
+// behavior matrix: for each case, an egress packet is followed by a
+// reply from either the remote it was sent to or a different one, and
+// the reply is expected to be let through only when the filtering
+// behavior permits that remote.
+func TestMappingFilteringMatrix(t *testing.T) {
+	cases := []struct {
+		name       string
+		mapping    nat.MappingBehavior
+		filtering  nat.FilteringBehavior
+		replyFrom  types.IPv4Address
+		replyAllow bool
+	}{
+		{"EIM/EIF allows any remote", nat.EndpointIndependentMapping, nat.EndpointIndependentFiltering, remoteIP2, true},
+		{"EIM/ADF blocks unseen remote", nat.EndpointIndependentMapping, nat.AddressDependentFiltering, remoteIP2, false},
+		{"EIM/ADF allows seen remote", nat.EndpointIndependentMapping, nat.AddressDependentFiltering, remoteIP, true},
+		{"APDM/APDF blocks unseen remote", nat.AddressAndPortDependentMapping, nat.AddressAndPortDependentFiltering, remoteIP2, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := New(Config{
+				Public:            VirtualPort{MAC: publicMAC, IPv4: publicIP},
+				Private:           VirtualPort{MAC: privateMAC, IPv4: privateIP},
+				MappingBehavior:   c.mapping,
+				FilteringBehavior: c.filtering,
+			})
+
+			egress := UDPPacket(privateMAC, publicMAC, privateIP, remoteIP, 40000, 53, []byte("query"))
+			if dir := h.SendFromPrivate(egress); dir != DirSEND {
+				t.Fatalf("egress packet: got dir %d, want DirSEND", dir)
+			}
+			// allocNewPort never preserves the private port, so the
+			// reply must be addressed to whatever port was actually
+			// allocated rather than the private side's original 40000.
+			natPort := packet.SwapBytesUint16(egress.GetUDPNoCheck().SrcPort)
+
+			reply := UDPPacket(peerMAC, publicMAC, c.replyFrom, publicIP, 53, natPort, []byte("reply"))
+			dir := h.SendFromPublic(reply)
+			if c.replyAllow && dir != DirSEND {
+				t.Errorf("reply from %v: got dir %d, want DirSEND", c.replyFrom, dir)
+			}
+			if !c.replyAllow && dir == DirSEND {
+				t.Errorf("reply from %v: got DirSEND, want drop", c.replyFrom)
+			}
+		})
+	}
+}
+
+// TestTCPHandshakeAndTermination drives a SYN/SYN-ACK/ACK handshake
+// followed by a FIN/FIN/ACK close, checking that each packet up to the
+// second FIN is forwarded; the final ACK is sent, but neither its
+// result nor the mapping's teardown is checked.
+func TestTCPHandshakeAndTermination(t *testing.T) {
+	h := New(Config{
+		Public:  VirtualPort{MAC: publicMAC, IPv4: publicIP},
+		Private: VirtualPort{MAC: privateMAC, IPv4: privateIP},
+	})
+
+	syn := TCPPacket(privateMAC, publicMAC, privateIP, remoteIP, 50000, 443, types.TCPFlagSyn)
+	if dir := h.SendFromPrivate(syn); dir != DirSEND {
+		t.Fatalf("SYN: got dir %d, want DirSEND", dir)
+	}
+	// allocNewPort never preserves the private port, so every packet
+	// addressed to this mapping from here on must use the port it
+	// actually allocated, not the private side's original 50000.
+	natPort := packet.SwapBytesUint16(syn.GetTCPNoCheck().SrcPort)
+
+	synAck := TCPPacket(peerMAC, publicMAC, remoteIP, publicIP, 443, natPort, types.TCPFlagSyn|types.TCPFlagAck)
+	if dir := h.SendFromPublic(synAck); dir != DirSEND {
+		t.Fatalf("SYN-ACK: got dir %d, want DirSEND", dir)
+	}
+
+	ack := TCPPacket(privateMAC, publicMAC, privateIP, remoteIP, 50000, 443, types.TCPFlagAck)
+	if dir := h.SendFromPrivate(ack); dir != DirSEND {
+		t.Fatalf("ACK: got dir %d, want DirSEND", dir)
+	}
+
+	finPriv := TCPPacket(privateMAC, publicMAC, privateIP, remoteIP, 50000, 443, types.TCPFlagFin|types.TCPFlagAck)
+	if dir := h.SendFromPrivate(finPriv); dir != DirSEND {
+		t.Fatalf("FIN (private): got dir %d, want DirSEND", dir)
+	}
+
+	finPub := TCPPacket(peerMAC, publicMAC, remoteIP, publicIP, 443, natPort, types.TCPFlagFin|types.TCPFlagAck)
+	if dir := h.SendFromPublic(finPub); dir != DirSEND {
+		t.Fatalf("FIN (public): got dir %d, want DirSEND", dir)
+	}
+
+	lastAck := TCPPacket(privateMAC, publicMAC, privateIP, remoteIP, 50000, 443, types.TCPFlagAck)
+	h.SendFromPrivate(lastAck)
+}
+
+// TestHairpinning checks that a private host reaching another private
+// host's public mapping is looped back out the private port instead
+// of being sent externally.
+func TestHairpinning(t *testing.T) {
+	privateIP2 := types.IPv4Address(0x0a000002) // 10.0.0.2
+
+	h := New(Config{
+		Public:      VirtualPort{MAC: publicMAC, IPv4: publicIP},
+		Private:     VirtualPort{MAC: privateMAC, IPv4: privateIP},
+		HairpinMode: nat.HairpinFull,
+	})
+
+	// Host 2 talks out first so it gets a public mapping.
+	egress := UDPPacket(privateMAC, publicMAC, privateIP2, remoteIP, 60000, 53, []byte("q"))
+	if dir := h.SendFromPrivate(egress); dir != DirSEND {
+		t.Fatalf("egress for host 2: got dir %d, want DirSEND", dir)
+	}
+	// allocNewPort never preserves the private port, so host 1 must
+	// address whatever port was actually allocated for host 2, not
+	// host 2's original 60000.
+	natPort := packet.SwapBytesUint16(egress.GetUDPNoCheck().SrcPort)
+
+	// Host 1 now addresses host 2 via the NAT's public mapping for it.
+	hairpin := UDPPacket(privateMAC, publicMAC, privateIP, publicIP, 61000, natPort, []byte("hi"))
+	dir := h.SendFromPrivate(hairpin)
+	if dir != DirPrivateLoop {
+		t.Errorf("hairpin packet: got dir %d, want DirPrivateLoop (looped back privately)", dir)
+	}
+}
+
+// TestICMPRewriting checks that an outbound ICMP echo request has its
+// source address and identifier rewritten to the public mapping the
+// same way a UDP packet's address and port would be, and that the
+// matching echo reply is translated back to the private host.
+func TestICMPRewriting(t *testing.T) {
+	h := New(Config{
+		Public:  VirtualPort{MAC: publicMAC, IPv4: publicIP},
+		Private: VirtualPort{MAC: privateMAC, IPv4: privateIP},
+	})
+
+	echo := ICMPEchoPacket(privateMAC, publicMAC, privateIP, remoteIP, 1234, 1)
+	if dir := h.SendFromPrivate(echo); dir != DirSEND {
+		t.Fatalf("echo request: got dir %d, want DirSEND", dir)
+	}
+	if got := packet.SwapBytesIPv4Addr(echo.GetIPv4NoCheck().SrcAddr); got != publicIP {
+		t.Errorf("echo request: source rewritten to %v, want %v", got, publicIP)
+	}
+	natIdentifier := packet.SwapBytesUint16(echo.GetICMPNoCheck().Identifier)
+
+	reply := ICMPEchoPacket(peerMAC, publicMAC, remoteIP, publicIP, natIdentifier, 1)
+	reply.GetICMPNoCheck().Type = types.ICMPTypeEchoReply
+	if dir := h.SendFromPublic(reply); dir != DirSEND {
+		t.Fatalf("echo reply: got dir %d, want DirSEND", dir)
+	}
+	if got := packet.SwapBytesIPv4Addr(reply.GetIPv4NoCheck().DstAddr); got != privateIP {
+		t.Errorf("echo reply: destination rewritten to %v, want %v", got, privateIP)
+	}
+}
+
+// TestFragmentReassembly checks that a UDP datagram split across two
+// IPv4 fragments is reassembled before translation: the leading
+// fragment alone must not be forwarded, and the translated datagram
+// produced once the trailing fragment arrives must carry the full
+// payload with the source address/port rewritten exactly as an
+// unfragmented packet's would be.
+func TestFragmentReassembly(t *testing.T) {
+	h := New(Config{
+		Public:  VirtualPort{MAC: publicMAC, IPv4: publicIP},
+		Private: VirtualPort{MAC: privateMAC, IPv4: privateIP},
+	})
+
+	payload := []byte("this payload is split across two IPv4 fragments")
+	first, second := IPv4Fragments(privateMAC, publicMAC, privateIP, remoteIP, 40000, 53, payload, 16)
+
+	if dir := h.SendFromPrivate(first); dir != DirDROP {
+		t.Fatalf("leading fragment: got dir %d, want DirDROP (buffered, not forwarded)", dir)
+	}
+
+	if dir := h.SendFromPrivate(second); dir != DirSEND {
+		t.Fatalf("trailing fragment: got dir %d, want DirSEND", dir)
+	}
+	if got := packet.SwapBytesIPv4Addr(second.GetIPv4NoCheck().SrcAddr); got != publicIP {
+		t.Errorf("reassembled datagram: source rewritten to %v, want %v", got, publicIP)
+	}
+	if got := second.GetPacketPayload(); string(got) != string(payload) {
+		t.Errorf("reassembled datagram: payload = %q, want %q", got, payload)
+	}
+}
+
+// TestDHCPAddressAcquisition checks that a DHCP server reply arriving
+// on the public port is consumed rather than translated, and that the
+// leased address it carries becomes usable as the public port's own
+// egress source address.
+func TestDHCPAddressAcquisition(t *testing.T) {
+	h := New(Config{
+		Public:  VirtualPort{MAC: publicMAC},
+		Private: VirtualPort{MAC: privateMAC, IPv4: privateIP},
+	})
+
+	leasedIP := types.IPv4Address(0x0b0c0d0e) // 11.12.13.14
+	offer := DHCPAckPacket(peerMAC, publicMAC, remoteIP, 0, leasedIP)
+	if dir := h.SendFromPublic(offer); dir != DirDROP {
+		t.Fatalf("DHCP reply: got dir %d, want DirDROP (consumed, not translated)", dir)
+	}
+
+	egress := UDPPacket(privateMAC, publicMAC, privateIP, remoteIP, 40000, 53, []byte("query"))
+	if dir := h.SendFromPrivate(egress); dir != DirSEND {
+		t.Fatalf("egress after DHCP acquisition: got dir %d, want DirSEND", dir)
+	}
+	if got := packet.SwapBytesIPv4Addr(egress.GetIPv4NoCheck().SrcAddr); got != leasedIP {
+		t.Errorf("egress source address: got %v, want leased address %v", got, leasedIP)
+	}
+}
+
+// TestSTUNBindingRequest checks both STUN entry points: a public port
+// answering an external probe with the requester's own observed
+// address, and a private host querying its own allocated public
+// mapping, which must report the mapping a real flow to remoteIP
+// already created rather than a synthetic one.
+func TestSTUNBindingRequest(t *testing.T) {
+	h := New(Config{
+		Public:   VirtualPort{MAC: publicMAC, IPv4: publicIP},
+		Private:  VirtualPort{MAC: privateMAC, IPv4: privateIP},
+		StunPort: 3478,
+	})
+
+	t.Run("external probe", func(t *testing.T) {
+		txID := [12]byte{1, 2, 3}
+		probe := STUNBindingRequestPacket(peerMAC, publicMAC, remoteIP, publicIP, 54321, 3478, txID)
+		dir := h.SendFromPublic(probe)
+		if dir != DirPublicLoop {
+			t.Fatalf("probe: got dir %d, want DirPublicLoop", dir)
+		}
+		addr, port, ok := ParseSTUNXorMappedAddressIPv4(probe.GetPacketPayload())
+		if !ok {
+			t.Fatalf("probe response: not a well-formed STUN message")
+		}
+		if addr != remoteIP || port != 54321 {
+			t.Errorf("probe response: XOR-MAPPED-ADDRESS = %v:%d, want %v:54321", addr, port, remoteIP)
+		}
+	})
+
+	t.Run("self query reports the real mapping", func(t *testing.T) {
+		egress := UDPPacket(privateMAC, publicMAC, privateIP, remoteIP, 40000, 53, []byte("query"))
+		if dir := h.SendFromPrivate(egress); dir != DirSEND {
+			t.Fatalf("egress: got dir %d, want DirSEND", dir)
+		}
+		natPort := packet.SwapBytesUint16(egress.GetUDPNoCheck().SrcPort)
+
+		txID := [12]byte{4, 5, 6}
+		query := STUNBindingRequestPacket(privateMAC, publicMAC, privateIP, publicIP, 40000, 3478, txID)
+		dir := h.SendFromPrivate(query)
+		if dir != DirPrivateLoop {
+			t.Fatalf("self query: got dir %d, want DirPrivateLoop", dir)
+		}
+		addr, port, ok := ParseSTUNXorMappedAddressIPv4(query.GetPacketPayload())
+		if !ok {
+			t.Fatalf("self query response: not a well-formed STUN message")
+		}
+		if addr != publicIP || port != natPort {
+			t.Errorf("self query response: XOR-MAPPED-ADDRESS = %v:%d, want %v:%d (the real mapping egress created)", addr, port, publicIP, natPort)
+		}
+	})
+}
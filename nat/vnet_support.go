@@ -0,0 +1,92 @@
+// Copyright 2017-2018 Intel Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat
+
+import (
+	"github.com/intel-go/nff-go/flow"
+	"github.com/intel-go/nff-go/types"
+)
+
+// VirtualEndpoint describes the in-memory configuration of one side of
+// a port pair, for use by the nat/vnet test harness. It mirrors the
+// subset of ipPort's static configuration that PublicToPrivateTranslation
+// and PrivateToPublicTranslation consult, so a portPair built from two
+// VirtualEndpoints behaves like a real one without any DPDK ports
+// backing it.
+type VirtualEndpoint struct {
+	MACAddress types.MACAddress
+	IPv4Addr   types.IPv4Address
+	IPv6Addr   types.IPv6Address
+	KNIName    string
+
+	// Pool configures additional global unicast addresses
+	// selectEgressAddr6 can choose this endpoint's egress source
+	// address from, e.g. to exercise AddressSelectionPolicy. Addresses
+	// that aren't global unicast are silently refused, exactly as a
+	// real DHCPv6-PD delegation feeding ipSubnet6.Pool would be.
+	Pool             []PoolAddress
+	AddressSelection AddressSelectionPolicy
+
+	MappingBehavior   MappingBehavior
+	FilteringBehavior FilteringBehavior
+	HairpinMode       HairpinMode
+
+	// StunPort configures the UDP port this endpoint answers STUN
+	// Binding Requests on; 0 disables the responder (see stun.go).
+	StunPort uint16
+}
+
+// PoolAddress configures one address in an ipSubnet6's egress pool,
+// for use by VirtualEndpoint.Pool.
+type PoolAddress struct {
+	Addr            types.IPv6Address
+	PinnedPrefix    types.IPv6Address
+	PinnedPrefixLen uint8
+}
+
+// NewVirtualPortPair registers a new portPair built entirely from
+// in-memory state and returns the flow.UserContext that
+// PublicToPrivateTranslation/PrivateToPublicTranslation expect as their
+// ctx argument, so nat/vnet can call them directly without a flow
+// scheduler.
+func NewVirtualPortPair(public, private VirtualEndpoint) flow.UserContext {
+	pp := portPair{
+		MappingBehavior:   public.MappingBehavior,
+		FilteringBehavior: public.FilteringBehavior,
+		HairpinMode:       public.HairpinMode,
+	}
+
+	pp.PublicPort = ipPort{
+		Subnet:        ipSubnet{Addr: public.IPv4Addr, addressAcquired: public.IPv4Addr != 0},
+		Subnet6:       ipSubnet6{Addr: public.IPv6Addr, addressAcquired: public.IPv6Addr != types.IPv6Address{}, AddressSelection: public.AddressSelection},
+		SrcMACAddress: public.MACAddress,
+		KNIName:       public.KNIName,
+		StunPort:      public.StunPort,
+		fragments:     newFragmentReassembler(),
+	}
+	for _, p := range public.Pool {
+		pp.PublicPort.Subnet6.AddPoolAddress(p.Addr, p.PinnedPrefix, p.PinnedPrefixLen)
+	}
+	pp.PrivatePort = ipPort{
+		Subnet:        ipSubnet{Addr: private.IPv4Addr, addressAcquired: private.IPv4Addr != 0},
+		Subnet6:       ipSubnet6{Addr: private.IPv6Addr, addressAcquired: private.IPv6Addr != types.IPv6Address{}},
+		SrcMACAddress: private.MACAddress,
+		KNIName:       private.KNIName,
+		StunPort:      private.StunPort,
+		fragments:     newFragmentReassembler(),
+	}
+
+	// pp is appended by value below, so opposite must point into the
+	// slice element that actually ends up stored in Natconfig.PortPairs,
+	// not into this local variable: setting it beforehand would leave
+	// every lookup through opposite reading a copy that's orphaned the
+	// moment append returns.
+	Natconfig.PortPairs = append(Natconfig.PortPairs, pp)
+	stored := &Natconfig.PortPairs[len(Natconfig.PortPairs)-1]
+	stored.PublicPort.opposite = &stored.PrivatePort
+	stored.PrivatePort.opposite = &stored.PublicPort
+
+	return pairIndex{index: len(Natconfig.PortPairs) - 1}
+}